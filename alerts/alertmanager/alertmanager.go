@@ -0,0 +1,172 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alertmanager a Notifier that delivers alerts.Event to one or
+// more Alertmanager v2 endpoints
+package alertmanager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/alerts"
+)
+
+// queueSize the bounded in-memory queue size; once full, new events are
+// dropped (and logged) rather than blocking the evaluator goroutine
+const queueSize = 1024
+
+// maxRetries bound the number of delivery attempts per event and endpoint
+const maxRetries = 5
+
+// initialBackoff the first retry delay; doubled on every subsequent
+// failed attempt, up to maxBackoff
+const initialBackoff = 1 * time.Second
+const maxBackoff = 1 * time.Minute
+
+// envelopeEntry a single Alertmanager v2 alert, as POSTed to
+// /api/v2/alerts
+type envelopeEntry struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Notifier delivers alerts.Event to one or more Alertmanager endpoints
+type Notifier struct {
+	// URLs the Alertmanager v2 API endpoints, e.g. "http://am:9093/api/v2/alerts"
+	URLs []string
+	// BasicAuthUser/BasicAuthPass basic auth credentials, optional
+	BasicAuthUser string
+	BasicAuthPass string
+	// BearerToken a bearer token, optional, takes precedence over basic auth
+	BearerToken string
+	// TLSInsecure skip TLS certificate verification
+	TLSInsecure bool
+
+	client *http.Client
+	queue  chan alerts.Event
+}
+
+// Init start the background dispatcher goroutine; must be called once
+// before Notify
+func (n *Notifier) Init() {
+	n.client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: n.TLSInsecure},
+		},
+	}
+	n.queue = make(chan alerts.Event, queueSize)
+
+	go n.run()
+}
+
+// Notify enqueue an event for delivery, returning immediately. A full
+// queue (a wedged or down Alertmanager) causes the event to be dropped.
+func (n *Notifier) Notify(e alerts.Event) error {
+	select {
+	case n.queue <- e:
+		return nil
+	default:
+		log.Printf("alertmanager, queue full, dropping event for %v", e.Labels)
+		return nil
+	}
+}
+
+// run drain the queue, delivering events with bounded exponential
+// backoff retries
+func (n *Notifier) run() {
+	for e := range n.queue {
+		n.deliver(e)
+	}
+}
+
+// deliver POST a single event to every configured Alertmanager endpoint
+func (n *Notifier) deliver(e alerts.Event) {
+	body, err := json.Marshal([]envelopeEntry{{
+		Labels:       e.Labels,
+		Annotations:  e.Annotations,
+		StartsAt:     e.StartsAt,
+		EndsAt:       e.EndsAt,
+		GeneratorURL: e.GeneratorURL,
+	}})
+	if err != nil {
+		log.Printf("alertmanager, failed to encode event: %v", err)
+		return
+	}
+
+	for _, url := range n.URLs {
+		backoff := initialBackoff
+
+		for attempt := 0; attempt < maxRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				if backoff < maxBackoff {
+					backoff *= 2
+				}
+			}
+
+			if err := n.post(url, body); err != nil {
+				log.Printf("alertmanager, delivery to %s failed (attempt %d): %v", url, attempt+1, err)
+				continue
+			}
+
+			break
+		}
+	}
+}
+
+// post send the alert envelope to a single Alertmanager endpoint
+func (n *Notifier) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if n.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+n.BearerToken)
+	} else if n.BasicAuthUser != "" {
+		req.SetBasicAuth(n.BasicAuthUser, n.BasicAuthPass)
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return &statusError{res.StatusCode}
+	}
+
+	return nil
+}
+
+// statusError a non-2xx HTTP response from an Alertmanager endpoint
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return http.StatusText(e.code)
+}
@@ -0,0 +1,189 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alerts a simple threshold alert evaluator for the Mohawk
+// storage backend
+package alerts
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/MohawkTSDB/mohawk/storage"
+)
+
+// defaultResendDelay how often a still-firing alert is re-sent to its
+// Notifiers, unless the alert config sets its own resendDelay
+const defaultResendDelay = 5 * time.Minute
+
+// defaultCheckInterval how often an alert's condition is re-evaluated
+const defaultCheckInterval = 1 * time.Minute
+
+// state the evaluator's view of a single Alert
+type state int
+
+const (
+	stateOK state = iota
+	statePending
+	stateFiring
+)
+
+// Alert a single threshold alert, as parsed from the `alerts` config yaml
+type Alert struct {
+	ID          string            `mapstructure:"id"`
+	Tenant      string            `mapstructure:"tenant"`
+	Metric      string            `mapstructure:"metric"`
+	Condition   string            `mapstructure:"condition"` // one of >, >=, <, <=
+	Threshold   float64           `mapstructure:"threshold"`
+	For         time.Duration     `mapstructure:"for"`
+	ResendDelay time.Duration     `mapstructure:"resendDelay"`
+	Labels      map[string]string `mapstructure:"labels"`
+	Annotations map[string]string `mapstructure:"annotations"`
+
+	state      state
+	pendingAt  time.Time
+	firingAt   time.Time
+	lastSentAt time.Time
+}
+
+// Alerts evaluate a list of Alert against a storage.Backend and dispatch
+// state transitions to a list of Notifiers
+type Alerts struct {
+	Backend   storage.Backend
+	Verbose   bool
+	Alerts    []*Alert
+	Notifiers []Notifier
+}
+
+// Init start one evaluator goroutine per configured Alert
+func (a *Alerts) Init() {
+	for _, alert := range a.Alerts {
+		go a.run(alert)
+	}
+}
+
+// run periodically evaluate a single Alert's condition and dispatch
+// pending->firing, resend and resolved events
+func (a *Alerts) run(alert *Alert) {
+	for range time.Tick(defaultCheckInterval) {
+		a.evaluate(alert)
+	}
+}
+
+// evaluate check a single Alert's condition once, advancing its state
+// machine and emitting an Event on every transition that matters
+func (a *Alerts) evaluate(alert *Alert) {
+	value, ok := a.latestValue(alert)
+	if !ok {
+		return
+	}
+
+	breached := breaches(alert.Condition, value, alert.Threshold)
+	now := time.Now()
+
+	switch alert.state {
+	case stateOK:
+		if breached {
+			alert.state = statePending
+			alert.pendingAt = now
+		}
+	case statePending:
+		if !breached {
+			alert.state = stateOK
+			return
+		}
+		if now.Sub(alert.pendingAt) >= alert.For {
+			alert.state = stateFiring
+			alert.firingAt = now
+			alert.lastSentAt = now
+			a.notify(alert, now, time.Time{})
+		}
+	case stateFiring:
+		if !breached {
+			alert.state = stateOK
+			a.notify(alert, alert.firingAt, now)
+			return
+		}
+
+		resendDelay := alert.ResendDelay
+		if resendDelay <= 0 {
+			resendDelay = defaultResendDelay
+		}
+		if now.Sub(alert.lastSentAt) >= resendDelay {
+			alert.lastSentAt = now
+			a.notify(alert, alert.firingAt, time.Time{})
+		}
+	}
+}
+
+// notify build an Event for alert and hand it to every configured
+// Notifier; a down Notifier must not block the evaluator, so each is
+// notified in its own goroutine
+func (a *Alerts) notify(alert *Alert, startsAt, endsAt time.Time) {
+	e := Event{
+		Labels:      alert.Labels,
+		Annotations: alert.Annotations,
+		StartsAt:    startsAt,
+		EndsAt:      endsAt,
+	}
+
+	for _, n := range a.Notifiers {
+		n := n
+		go func() {
+			if err := n.Notify(e); err != nil {
+				log.Printf("alerts, notifier failed for %s: %v", alert.ID, err)
+			}
+		}()
+	}
+}
+
+// breaches evaluate condition (>, >=, <, <=) against threshold
+func breaches(condition string, value, threshold float64) bool {
+	switch condition {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	default:
+		return false
+	}
+}
+
+// rawDataPoint a single Hawkular raw data point, as returned by
+// storage.Backend.GetData
+type rawDataPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// latestValue fetch the most recent sample for alert.Metric
+func (a *Alerts) latestValue(alert *Alert) (float64, bool) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	start := now - int64(defaultCheckInterval/time.Millisecond)
+
+	data := a.Backend.GetData(alert.Tenant, "gauges", alert.Metric, start, now, 0)
+
+	var points []rawDataPoint
+	if err := json.Unmarshal(data, &points); err != nil || len(points) == 0 {
+		return 0, false
+	}
+
+	return points[len(points)-1].Value, true
+}
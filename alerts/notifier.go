@@ -0,0 +1,38 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerts
+
+import "time"
+
+// Event describes a single alert state transition, ready to be handed
+// to a Notifier. StartsAt is fixed at the "pending -> firing" edge;
+// EndsAt is the zero time while the alert is firing and set to the
+// resolution time once the alert clears.
+type Event struct {
+	Labels       map[string]string
+	Annotations  map[string]string
+	StartsAt     time.Time
+	EndsAt       time.Time
+	GeneratorURL string
+}
+
+// Notifier delivers fired/resolved alerts to an external system. Alerts
+// hands the events of every Alert to all of its Notifiers; a Notifier
+// implementation must not block the evaluator goroutine for longer than
+// it takes to enqueue the Event.
+type Notifier interface {
+	Notify(e Event) error
+}
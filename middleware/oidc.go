@@ -0,0 +1,307 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// contextKey a private type to avoid context key collisions with other
+// packages
+type contextKey string
+
+// TenantContextKey the context key GetMetrics/PostData and friends use
+// to read the tenant resolved by OIDCDecorator
+const TenantContextKey contextKey = "hawkular-tenant"
+
+// httpClientTimeout bounds every request to the issuer, so a slow or
+// silently unreachable provider can't wedge Serve() at startup
+const httpClientTimeout = 10 * time.Second
+
+// OIDCConfig the `auth` config block when `auth.type` is "oidc"
+type OIDCConfig struct {
+	Issuer      string
+	Audience    string
+	Claim       string
+	TenantMap   map[string]string
+	JWKSRefresh time.Duration
+}
+
+// oidcDiscovery the subset of the OpenID Connect discovery document we need
+type oidcDiscovery struct {
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// jsonWebKeySet mirrors the JWKS document, kept minimal on purpose
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Crv string `json:"crv"`
+}
+
+// oidcVerifier fetches and caches the provider's JWKS, refreshing it on
+// a kid miss
+type oidcVerifier struct {
+	cfg       OIDCConfig
+	client    *http.Client
+	jwksURI   string
+	mu        sync.RWMutex
+	keys      map[string]jsonWebKey
+	lastFetch time.Time
+}
+
+// newOIDCVerifier fetch the discovery document and the initial JWKS
+func newOIDCVerifier(cfg OIDCConfig) (*oidcVerifier, error) {
+	client := &http.Client{Timeout: httpClientTimeout}
+
+	res, err := client.Get(strings.TrimRight(cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var disco oidcDiscovery
+	if err := json.NewDecoder(res.Body).Decode(&disco); err != nil {
+		return nil, err
+	}
+
+	v := &oidcVerifier{
+		cfg:     cfg,
+		client:  client,
+		jwksURI: disco.JWKSURI,
+		keys:    map[string]jsonWebKey{},
+	}
+
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+
+	go v.refreshLoop()
+
+	return v, nil
+}
+
+// refreshLoop re-fetch the JWKS on cfg.JWKSRefresh, in addition to the
+// on-demand refresh triggered by a kid miss, so a provider that rotates
+// keys without the old kid ever going stale is still picked up
+func (v *oidcVerifier) refreshLoop() {
+	for range time.Tick(v.cfg.JWKSRefresh) {
+		if err := v.refresh(); err != nil {
+			log.Printf("oidc, periodic JWKS refresh failed: %v", err)
+		}
+	}
+}
+
+// refresh re-fetch the JWKS document
+func (v *oidcVerifier) refresh() error {
+	res, err := v.client.Get(v.jwksURI)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var jwks jsonWebKeySet
+	if err := json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]jsonWebKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		keys[k.Kid] = k
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.lastFetch = time.Now()
+	v.mu.Unlock()
+
+	return nil
+}
+
+// key return the key for kid, refreshing the JWKS once on a miss
+func (v *oidcVerifier) key(kid string) (jsonWebKey, bool) {
+	v.mu.RLock()
+	k, ok := v.keys[kid]
+	v.mu.RUnlock()
+
+	if ok {
+		return k, true
+	}
+
+	if err := v.refresh(); err != nil {
+		return jsonWebKey{}, false
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	k, ok = v.keys[kid]
+
+	return k, ok
+}
+
+// verify parse and validate a raw JWT, returning the requested claim
+func (v *oidcVerifier) verify(raw string) (string, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return "", err
+	}
+	if len(tok.Headers) == 0 {
+		return "", fmt.Errorf("oidc, token has no header")
+	}
+
+	key, ok := v.key(tok.Headers[0].KeyID)
+	if !ok {
+		return "", fmt.Errorf("oidc, unknown kid: %s", tok.Headers[0].KeyID)
+	}
+
+	pub, err := publicKeyFromJWK(key)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.Claims{}
+	extra := map[string]interface{}{}
+	if err := tok.Claims(pub, &claims, &extra); err != nil {
+		return "", err
+	}
+
+	if err := claims.Validate(jwt.Expected{Issuer: v.cfg.Issuer, Audience: jwt.Audience{v.cfg.Audience}, Time: time.Now()}); err != nil {
+		return "", err
+	}
+
+	claim := v.cfg.Claim
+	if claim == "" {
+		claim = "preferred_username"
+	}
+
+	if value, ok := extra[claim].(string); ok && value != "" {
+		return value, nil
+	}
+
+	return claims.Subject, nil
+}
+
+// publicKeyFromJWK decode an RSA (RS256) or EC (ES256) JWK into a Go
+// public key usable to verify a token's signature
+func publicKeyFromJWK(k jsonWebKey) (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		eInt := 0
+		for _, b := range e {
+			eInt = eInt<<8 | int(b)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: eInt}, nil
+	case "EC":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		curve := elliptic.P256()
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidc, unsupported curve: %s", k.Crv)
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("oidc, unsupported key type: %s", k.Kty)
+}
+
+// OIDCDecorator validate `Authorization: Bearer <JWT>` against an OIDC
+// provider, inject the resolved tenant into the request context and
+// override the Hawkular-Tenant header with it, scoping downstream
+// handlers to the caller's OIDC tenant regardless of what the caller
+// sent
+func OIDCDecorator(cfg OIDCConfig) Decorator {
+	if cfg.JWKSRefresh <= 0 {
+		cfg.JWKSRefresh = time.Hour
+	}
+
+	verifier, err := newOIDCVerifier(cfg)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err != nil {
+				http.Error(w, "oidc provider unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") {
+				http.Error(w, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			claimValue, err := verifier.verify(strings.TrimPrefix(auth, "Bearer "))
+			if err != nil {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			tenant := claimValue
+			if mapped, ok := cfg.TenantMap[claimValue]; ok {
+				tenant = mapped
+			}
+
+			// the claim-derived tenant always wins over any
+			// caller-supplied Hawkular-Tenant header, so an
+			// authenticated caller can't escape their OIDC-scoped
+			// tenant by setting the header themselves
+			r.Header.Set("Hawkular-Tenant", tenant)
+
+			ctx := context.WithValue(r.Context(), TenantContextKey, tenant)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// letsEncryptProductionURL the default ACME directory used when no
+// caServer is configured
+const letsEncryptProductionURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+// renewBefore renew a certificate once it is within this window of expiry
+const renewBefore = 30 * 24 * time.Hour
+
+// accountKeySuffix appended to acmeConfig.Storage to derive the path
+// used to persist the ACME account key, so restarts reuse the same
+// registered account instead of registering a new one every time
+const accountKeySuffix = ".account.key"
+
+// acmeConfig the `acme` config block, parsed through viper like the
+// existing `alerts` block
+type acmeConfig struct {
+	Enabled           bool
+	Email             string
+	Domains           []string
+	Storage           string
+	CAServer          string
+	HTTPChallengePort int
+}
+
+// acmeCertEntry a single cached certificate, as persisted to the
+// acmeConfig.Storage JSON file. Certificate holds the full chain
+// returned by the CA (leaf first, followed by any intermediates) so
+// that clients which don't chase AIA can still validate it.
+type acmeCertEntry struct {
+	Certificate [][]byte  `json:"certificate"`
+	PrivateKey  []byte    `json:"privateKey"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+// acmeManager obtains and renews certificates using the ACME HTTP-01
+// challenge, caching issued certificates on disk
+type acmeManager struct {
+	cfg    acmeConfig
+	client *acme.Client
+
+	mu    sync.Mutex
+	certs map[string]*acmeCertEntry
+	tls   map[string]*tls.Certificate
+}
+
+// splitDomains parse a comma/semicolon-separated SAN list
+func splitDomains(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';'
+	})
+
+	domains := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if d := strings.TrimSpace(f); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	return domains
+}
+
+// newACMEManager create an acmeManager, loading any cached certificates
+// from cfg.Storage and registering an ACME account if needed
+func newACMEManager(cfg acmeConfig) (*acmeManager, error) {
+	if cfg.CAServer == "" {
+		cfg.CAServer = letsEncryptProductionURL
+	}
+
+	key, err := loadOrCreateAccountKey(cfg.Storage + accountKeySuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &acmeManager{
+		cfg:   cfg,
+		certs: map[string]*acmeCertEntry{},
+		tls:   map[string]*tls.Certificate{},
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.CAServer,
+		},
+	}
+
+	m.load()
+
+	if _, err := m.client.Register(context.Background(), &acme.Account{Contact: []string{"mailto:" + cfg.Email}}, acme.AcceptTOS); err != nil {
+		log.Printf("ACME, account registration failed: %v", err)
+	}
+
+	return m, nil
+}
+
+// loadOrCreateAccountKey read the ACME account key from path, generating
+// and persisting a new one if it doesn't exist yet
+func loadOrCreateAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return x509.ParseECPrivateKey(data)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path, keyDER, 0600); err != nil {
+		log.Printf("ACME, failed to persist account key %s: %v", path, err)
+	}
+
+	return key, nil
+}
+
+// load read the certificate cache from disk, if present
+func (m *acmeManager) load() {
+	data, err := ioutil.ReadFile(m.cfg.Storage)
+	if err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(data, &m.certs); err != nil {
+		log.Printf("ACME, failed to parse cert storage %s: %v", m.cfg.Storage, err)
+		return
+	}
+
+	for domain, entry := range m.certs {
+		key, err := x509.ParseECPrivateKey(entry.PrivateKey)
+		if err != nil {
+			log.Printf("ACME, failed to parse cached key for %s: %v", domain, err)
+			continue
+		}
+
+		m.tls[domain] = &tls.Certificate{
+			Certificate: entry.Certificate,
+			PrivateKey:  key,
+		}
+	}
+}
+
+// save persist the certificate cache to disk
+func (m *acmeManager) save() {
+	data, err := json.Marshal(m.certs)
+	if err != nil {
+		log.Printf("ACME, failed to encode cert storage: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(m.cfg.Storage, data, 0600); err != nil {
+		log.Printf("ACME, failed to write cert storage %s: %v", m.cfg.Storage, err)
+	}
+}
+
+// obtain run the HTTP-01 challenge flow for domain and cache the issued
+// certificate
+func (m *acmeManager) obtain(domain string) error {
+	ctx := context.Background()
+
+	authz, err := m.client.Authorize(ctx, domain)
+	if err != nil {
+		return err
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME, no http-01 challenge offered for %s", domain)
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return err
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	csr, err := certRequest(certKey, domain)
+	if err != nil {
+		return err
+	}
+
+	der, _, err := m.client.CreateCert(ctx, csr, 0, true)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return err
+	}
+
+	entry := &acmeCertEntry{
+		Certificate: der,
+		PrivateKey:  keyDER,
+		NotAfter:    leaf.NotAfter,
+	}
+
+	// der (leaf followed by any intermediates) and certKey are already
+	// DER-encoded/parsed, so build the tls.Certificate directly instead
+	// of round-tripping through tls.X509KeyPair, which expects
+	// PEM-encoded input
+	cert := &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  certKey,
+		Leaf:        leaf,
+	}
+
+	m.mu.Lock()
+	m.certs[domain] = entry
+	m.tls[domain] = cert
+	m.mu.Unlock()
+
+	m.save()
+
+	return nil
+}
+
+// certRequest build a DER encoded certificate signing request for domain
+func certRequest(key *ecdsa.PrivateKey, domain string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
+
+// GetCertificate implements tls.Config.GetCertificate, serving the
+// cached certificate for the requested SNI and triggering an
+// asynchronous renewal once it is close to expiry
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !m.domainAllowed(hello.ServerName) {
+		return nil, fmt.Errorf("ACME, %s is not in the configured acme.domains list", hello.ServerName)
+	}
+
+	m.mu.Lock()
+	entry, hasEntry := m.certs[hello.ServerName]
+	cert, hasCert := m.tls[hello.ServerName]
+	m.mu.Unlock()
+
+	if !hasCert {
+		if err := m.obtain(hello.ServerName); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		cert = m.tls[hello.ServerName]
+		m.mu.Unlock()
+
+		return cert, nil
+	}
+
+	if hasEntry && time.Until(entry.NotAfter) < renewBefore {
+		go func() {
+			if err := m.obtain(hello.ServerName); err != nil {
+				log.Printf("ACME, renewal failed for %s: %v", hello.ServerName, err)
+			}
+		}()
+	}
+
+	return cert, nil
+}
+
+// domainAllowed report whether domain is in the configured acme.domains
+// allowlist, so a client sending an arbitrary SNI can't make the server
+// burn ACME issuance attempts (and rate limits) for hostnames the
+// operator never asked to provision
+func (m *acmeManager) domainAllowed(domain string) bool {
+	for _, d := range m.cfg.Domains {
+		if d == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renewLoop scan the cache hourly and renew certificates within the
+// renewal window
+func (m *acmeManager) renewLoop() {
+	for range time.Tick(time.Hour) {
+		m.mu.Lock()
+		domains := make([]string, 0, len(m.certs))
+		for domain, entry := range m.certs {
+			if time.Until(entry.NotAfter) < renewBefore {
+				domains = append(domains, domain)
+			}
+		}
+		m.mu.Unlock()
+
+		for _, domain := range domains {
+			if err := m.obtain(domain); err != nil {
+				log.Printf("ACME, renewal failed for %s: %v", domain, err)
+			}
+		}
+	}
+}
+
+// serveHTTPChallenge answer ACME HTTP-01 challenges on the configured
+// challenge port
+func (m *acmeManager) serveHTTPChallenge() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/acme-challenge/", func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+
+		resp, err := m.client.HTTP01ChallengeResponse(token)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		fmt.Fprint(w, resp)
+	})
+
+	addr := fmt.Sprintf("0.0.0.0:%d", m.cfg.HTTPChallengePort)
+	log.Printf("ACME, serve http-01 challenges on http://%s", addr)
+
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
@@ -0,0 +1,251 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// promGaugeType the Mohawk metric type used to store Prometheus samples
+const promGaugeType = "gauges"
+
+// defaultTenant the tenant used for remote-write/remote-read requests
+// that do not set the Hawkular-Tenant header
+const defaultTenant = "default"
+
+// rawDataPoint a single Hawkular raw data point, as consumed/produced by
+// the storage.Backend PostData/GetData JSON wire format
+type rawDataPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// idForLabels deterministically map a Prometheus label set to a Mohawk
+// metric id by serializing the label pairs, sorted by name, into a
+// single string. Each name and value is length-prefixed so a literal
+// "," or "=" inside a label value can't make two distinct label sets
+// collide onto the same id.
+func idForLabels(labels []*prompb.Label) string {
+	pairs := make([]*prompb.Label, len(labels))
+	copy(pairs, labels)
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+
+	parts := make([]string, 0, len(pairs))
+	for _, l := range pairs {
+		parts = append(parts, fmt.Sprintf("%d:%s=%d:%s", len(l.Name), l.Name, len(l.Value), l.Value))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// tagsForLabels turn a Prometheus label set into a Mohawk tags map so
+// existing tag filters (PutTags/GetMetrics) keep working on series
+// ingested over remote-write
+func tagsForLabels(labels []*prompb.Label) map[string]string {
+	tags := make(map[string]string, len(labels))
+	for _, l := range labels {
+		tags[l.Name] = l.Value
+	}
+
+	return tags
+}
+
+// PostPromWrite handle Prometheus remote-write requests, decoding a
+// snappy-framed protobuf WriteRequest and storing every TimeSeries as a
+// Mohawk gauge metric
+func (h Handler) PostPromWrite(w http.ResponseWriter, r *http.Request, argv map[string]string) {
+	tenantID := r.Header.Get("Hawkular-Tenant")
+	if tenantID == "" {
+		tenantID = defaultTenant
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		id := idForLabels(ts.Labels)
+		tags := tagsForLabels(ts.Labels)
+
+		if ok := h.Backend.PutTags(tenantID, promGaugeType, id, tags); !ok {
+			log.Printf("PostPromWrite, failed to store tags for id: %s", id)
+		}
+
+		points := make([]rawDataPoint, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			points = append(points, rawDataPoint{Timestamp: s.Timestamp, Value: s.Value})
+		}
+
+		data, err := json.Marshal([]map[string]interface{}{
+			{"id": id, "data": points},
+		})
+		if err != nil {
+			continue
+		}
+
+		if ok := h.Backend.PostData(tenantID, promGaugeType, data); !ok {
+			log.Printf("PostPromWrite, failed to store samples for id: %s", id)
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+// matchesSeries check a Mohawk tag set against a Prometheus matcher using
+// the EQ, NEQ, RE and NRE match types
+func matchesSeries(tags map[string]string, m *prompb.LabelMatcher) bool {
+	v := tags[m.Name]
+
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return v == m.Value
+	case prompb.LabelMatcher_NEQ:
+		return v != m.Value
+	case prompb.LabelMatcher_RE:
+		ok, err := regexp.MatchString("^(?:"+m.Value+")$", v)
+		return err == nil && ok
+	case prompb.LabelMatcher_NRE:
+		ok, err := regexp.MatchString("^(?:"+m.Value+")$", v)
+		return err != nil || !ok
+	}
+
+	return false
+}
+
+// metricDefinition the subset of a Hawkular metric definition (as
+// returned by storage.Backend.GetMetrics) needed to rebuild label sets
+type metricDefinition struct {
+	ID   string            `json:"id"`
+	Tags map[string]string `json:"tags"`
+}
+
+// PostPromRead handle Prometheus remote-read requests, translating each
+// Query's matchers into a tag filter, fetching the matching series raw
+// data and repacking it into a ReadResponse
+func (h Handler) PostPromRead(w http.ResponseWriter, r *http.Request, argv map[string]string) {
+	tenantID := r.Header.Get("Hawkular-Tenant")
+	if tenantID == "" {
+		tenantID = defaultTenant
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	res := prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+
+	metricsJSON := h.Backend.GetMetrics(tenantID, promGaugeType, "")
+
+	var defs []metricDefinition
+	if err := json.Unmarshal(metricsJSON, &defs); err != nil {
+		defs = []metricDefinition{}
+	}
+
+	for i, q := range req.Queries {
+		qr := &prompb.QueryResult{}
+
+		for _, def := range defs {
+			matched := true
+			for _, m := range q.Matchers {
+				if !matchesSeries(def.Tags, m) {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+
+			dataJSON := h.Backend.GetData(tenantID, promGaugeType, def.ID, q.StartTimestampMs, q.EndTimestampMs, 0)
+
+			var points []rawDataPoint
+			if err := json.Unmarshal(dataJSON, &points); err != nil {
+				continue
+			}
+
+			labels := make([]*prompb.Label, 0, len(def.Tags))
+			for name, value := range def.Tags {
+				labels = append(labels, &prompb.Label{Name: name, Value: value})
+			}
+
+			samples := make([]prompb.Sample, 0, len(points))
+			for _, p := range points {
+				samples = append(samples, prompb.Sample{Timestamp: p.Timestamp, Value: p.Value})
+			}
+
+			qr.Timeseries = append(qr.Timeseries, &prompb.TimeSeries{
+				Labels:  labels,
+				Samples: samples,
+			})
+		}
+
+		res.Results[i] = qr
+	}
+
+	data, err := proto.Marshal(&res)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.WriteHeader(200)
+	w.Write(snappy.Encode(nil, data))
+}
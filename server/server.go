@@ -17,6 +17,7 @@
 package api
 
 import (
+	tlsStdlib "crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -26,10 +27,12 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/MohawkTSDB/mohawk/alerts"
+	"github.com/MohawkTSDB/mohawk/alerts/alertmanager"
 	"github.com/MohawkTSDB/mohawk/middleware"
 	"github.com/MohawkTSDB/mohawk/router"
 	"github.com/MohawkTSDB/mohawk/storage"
 	"github.com/MohawkTSDB/mohawk/storage/example"
+	"github.com/MohawkTSDB/mohawk/storage/gorilla"
 	"github.com/MohawkTSDB/mohawk/storage/memory"
 	"github.com/MohawkTSDB/mohawk/storage/mongo"
 	"github.com/MohawkTSDB/mohawk/storage/sqlite"
@@ -68,6 +71,8 @@ func Serve() error {
 	var cert = viper.GetString("cert")
 	var key = viper.GetString("key")
 	var configAlerts = viper.ConfigFileUsed() != "" && viper.Get("alerts") != ""
+	var prometheus = viper.GetBool("prometheus")
+	var configACME = viper.GetBool("acme.enabled")
 
 	// Create and init the storage
 	switch backendQuery {
@@ -79,6 +84,8 @@ func Serve() error {
 		db = &mongo.Backend{}
 	case "example":
 		db = &example.Backend{}
+	case "gorilla":
+		db = &gorilla.Backend{}
 	default:
 		log.Fatal("Can't find storage:", backendQuery)
 	}
@@ -99,11 +106,43 @@ func Serve() error {
 		l := []*alerts.Alert{}
 		viper.UnmarshalKey("alerts", &l)
 
+		// parse the notifiers list and start an Alertmanager dispatcher
+		// for every configured endpoint, so fired/resolved alerts are
+		// delivered instead of only logged
+		type notifierConfig struct {
+			Type          string `mapstructure:"type"`
+			URL           string `mapstructure:"url"`
+			BasicAuthUser string `mapstructure:"basic_auth_user"`
+			BasicAuthPass string `mapstructure:"basic_auth_pass"`
+			BearerToken   string `mapstructure:"bearer_token"`
+			TLSInsecure   bool   `mapstructure:"tls_insecure"`
+		}
+		nConfigs := []notifierConfig{}
+		viper.UnmarshalKey("notifiers", &nConfigs)
+
+		notifiers := []alerts.Notifier{}
+		for _, nc := range nConfigs {
+			if nc.Type != "alertmanager" {
+				continue
+			}
+
+			am := &alertmanager.Notifier{
+				URLs:          []string{nc.URL},
+				BasicAuthUser: nc.BasicAuthUser,
+				BasicAuthPass: nc.BasicAuthPass,
+				BearerToken:   nc.BearerToken,
+				TLSInsecure:   nc.TLSInsecure,
+			}
+			am.Init()
+			notifiers = append(notifiers, am)
+		}
+
 		// creat and Init the alert handler
 		a := &alerts.Alerts{
-			Backend: db,
-			Verbose: verbose,
-			Alerts:  l,
+			Backend:   db,
+			Verbose:   verbose,
+			Alerts:    l,
+			Notifiers: notifiers,
 		}
 		a.Init()
 	}
@@ -163,9 +202,20 @@ func Serve() error {
 	rAvailability.Add("GET", ":id/raw", h.GetData)
 	rAvailability.Add("GET", ":id/stats", h.GetData)
 
+	// Prometheus remote-write / remote-read routing table, lets any
+	// Prometheus server use Mohawk as a long-term storage backend
+	rPrometheus := router.Router{
+		Prefix: "/api/v1/",
+	}
+	rPrometheus.Add("POST", "write", h.PostPromWrite)
+	rPrometheus.Add("POST", "read", h.PostPromRead)
+
 	// create a list of routes
 	routers := []*router.Router{}
 	routers = append(routers, &rGauges, &rCounters, &rAvailability, &rRoot)
+	if prometheus {
+		routers = append(routers, &rPrometheus)
+	}
 
 	// fallback handler, static decorator + bad request handler
 	staticDecorator := middleware.FileServeDecorator(media)
@@ -178,8 +228,25 @@ func Serve() error {
 	// create a list of middlwares
 	decorators := []middleware.Decorator{}
 	decorators = append(decorators, middleware.LoggingDecorator(log.Printf), middleware.DefaultHeadersDecorator())
-	if token != "" {
-		decorators = append(decorators, middleware.AuthDecorator(token, "^/hawkular/metrics/status$"))
+	switch viper.GetString("auth.type") {
+	case "oidc":
+		tenantMap := map[string]string{}
+		viper.UnmarshalKey("auth.tenant_map", &tenantMap)
+
+		oidcCfg := middleware.OIDCConfig{
+			Issuer:      viper.GetString("auth.issuer"),
+			Audience:    viper.GetString("auth.audience"),
+			Claim:       viper.GetString("auth.claim"),
+			TenantMap:   tenantMap,
+			JWKSRefresh: viper.GetDuration("auth.jwks_refresh"),
+		}
+		decorators = append(decorators, middleware.OIDCDecorator(oidcCfg))
+	case "token", "":
+		if token != "" {
+			decorators = append(decorators, middleware.AuthDecorator(token, "^/hawkular/metrics/status$"))
+		}
+	default:
+		log.Fatal("Can't find auth type:", viper.GetString("auth.type"))
 	}
 	if gzip {
 		decorators = append(decorators, middleware.GzipDecodeDecorator(), middleware.GzipEncodeDecorator())
@@ -196,7 +263,29 @@ func Serve() error {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	if tls {
+	if configACME {
+		acmeCfg := acmeConfig{
+			Enabled:           true,
+			Email:             viper.GetString("acme.email"),
+			Domains:           splitDomains(viper.GetString("acme.domains")),
+			Storage:           viper.GetString("acme.storage"),
+			CAServer:          viper.GetString("acme.caServer"),
+			HTTPChallengePort: viper.GetInt("acme.httpChallengePort"),
+		}
+
+		manager, err := newACMEManager(acmeCfg)
+		if err != nil {
+			log.Fatal("ACME, failed to start: ", err)
+		}
+
+		manager.serveHTTPChallenge()
+		go manager.renewLoop()
+
+		srv.TLSConfig = &tlsStdlib.Config{GetCertificate: manager.GetCertificate}
+
+		log.Printf("Start server, listen on https://%+v (ACME)", srv.Addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	} else if tls {
 		log.Printf("Start server, listen on https://%+v", srv.Addr)
 		log.Fatal(srv.ListenAndServeTLS(cert, key))
 	} else {
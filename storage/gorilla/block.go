@@ -0,0 +1,399 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorilla
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// blockDuration the span of a single block; the first sample appended to
+// a block anchors it to the containing blockDuration-wide window
+const blockDuration = 2 * 60 * 60 * 1000 // 2 hours, in milliseconds
+
+// sample a single decoded (timestamp, value) pair
+type sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// bitWriter accumulates bits into a byte buffer, most significant bit first
+type bitWriter struct {
+	buf  bytes.Buffer
+	cur  byte
+	nbit uint
+}
+
+func (w *bitWriter) writeBit(b byte) {
+	w.cur |= b << (7 - w.nbit)
+	w.nbit++
+	if w.nbit == 8 {
+		w.buf.WriteByte(w.cur)
+		w.cur = 0
+		w.nbit = 0
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(byte((v >> uint(i)) & 1))
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbit > 0 {
+		return append(append([]byte{}, w.buf.Bytes()...), w.cur)
+	}
+	return w.buf.Bytes()
+}
+
+// bitReader reads bits out of a byte slice, most significant bit first
+type bitReader struct {
+	data []byte
+	pos  int
+	nbit uint
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBit() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("gorilla, unexpected end of block")
+	}
+
+	b := (r.data[r.pos] >> (7 - r.nbit)) & 1
+	r.nbit++
+	if r.nbit == 8 {
+		r.nbit = 0
+		r.pos++
+	}
+
+	return b, nil
+}
+
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		b, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint64(b)
+	}
+	return v, nil
+}
+
+// block holds one blockDuration-wide window of encoded samples for a
+// single series. The first sample is stored verbatim; every following
+// sample is delta-of-delta encoded (timestamp) and XOR encoded (value),
+// following the Gorilla TSDB paper.
+type block struct {
+	StartTime int64
+
+	w          bitWriter
+	count      int
+	t0, t1     int64
+	prevDelta  int64
+	v0         uint64
+	leading    uint8
+	trailing   uint8
+	haveWindow bool
+}
+
+// newBlock create an empty block anchored at startTime
+func newBlock(startTime int64) *block {
+	return &block{StartTime: startTime}
+}
+
+// append add a sample to the block, rejecting out-of-order timestamps
+func (b *block) append(ts int64, value float64) error {
+	bits64 := math.Float64bits(value)
+
+	if b.count == 0 {
+		b.w.writeBits(uint64(ts), 64)
+		b.w.writeBits(bits64, 64)
+		b.t0 = ts
+		b.t1 = ts
+		b.v0 = bits64
+		b.count = 1
+		return nil
+	}
+
+	if ts <= b.t1 {
+		return fmt.Errorf("gorilla, out-of-order timestamp %d <= %d", ts, b.t1)
+	}
+
+	var delta int64
+	if b.count == 1 {
+		delta = ts - b.t0
+	} else {
+		delta = ts - b.t1
+	}
+	dod := delta - b.prevDelta
+	b.writeDoD(dod)
+
+	b.writeXOR(bits64)
+
+	b.prevDelta = delta
+	b.t1 = ts
+	b.v0 = bits64
+	b.count++
+
+	return nil
+}
+
+// writeDoD write a delta-of-delta timestamp using the Gorilla bucketed
+// variable-length encoding
+func (b *block) writeDoD(dod int64) {
+	switch {
+	case dod == 0:
+		b.w.writeBit(0)
+	case dod >= -63 && dod <= 64:
+		b.w.writeBits(0b10, 2)
+		b.w.writeBits(uint64(dod+63)&0x7f, 7)
+	case dod >= -255 && dod <= 256:
+		b.w.writeBits(0b110, 3)
+		b.w.writeBits(uint64(dod+255)&0x1ff, 9)
+	case dod >= -2047 && dod <= 2048:
+		b.w.writeBits(0b1110, 4)
+		b.w.writeBits(uint64(dod+2047)&0xfff, 12)
+	default:
+		b.w.writeBits(0b1111, 4)
+		b.w.writeBits(uint64(uint32(dod)), 32)
+	}
+}
+
+// writeXOR write a value using XOR-against-previous encoding
+func (b *block) writeXOR(bits64 uint64) {
+	xor := bits64 ^ b.v0
+
+	if xor == 0 {
+		b.w.writeBit(0)
+		return
+	}
+
+	b.w.writeBit(1)
+
+	leading := uint8(bits.LeadingZeros64(xor))
+	trailing := uint8(bits.TrailingZeros64(xor))
+
+	// the leading-zero count is written to a 5-bit field (0..31), so
+	// clamp before it feeds the reuse-window check or any meaningful-
+	// length math - otherwise the encoder's notion of "leading" would
+	// disagree with what the decoder reads back off the wire
+	if leading > 31 {
+		leading = 31
+	}
+
+	if b.haveWindow && leading >= b.leading && trailing >= b.trailing {
+		b.w.writeBit(0)
+		meaningful := 64 - b.leading - b.trailing
+		b.w.writeBits(xor>>b.trailing, uint(meaningful))
+		return
+	}
+
+	b.w.writeBit(1)
+	b.w.writeBits(uint64(leading), 5)
+	meaningful := 64 - leading - trailing
+	// meaningful ranges 1..64 (xor != 0, so leading+trailing <= 63), but a
+	// raw 6-bit field only holds 0..63. Bias by one on the wire so 64
+	// isn't silently truncated to 0.
+	b.w.writeBits(uint64(meaningful-1), 6)
+	b.w.writeBits(xor>>trailing, uint(meaningful))
+
+	b.leading = leading
+	b.trailing = trailing
+	b.haveWindow = true
+}
+
+// countHeaderSize the size, in bytes, of the sample count prepended to
+// every encoded block
+const countHeaderSize = 4
+
+// bytes return the block's on-disk representation: a big-endian uint32
+// sample count followed by the bit-packed stream. The count makes decode
+// exact - the bit-packed stream alone has no terminator, and the zero
+// bits bitWriter pads the final byte with would otherwise be
+// indistinguishable from valid dod=0/xor=0 codes.
+func (b *block) bytes() []byte {
+	header := make([]byte, countHeaderSize)
+	binary.BigEndian.PutUint32(header, uint32(b.count))
+
+	return append(header, b.w.bytes()...)
+}
+
+// decode replay the block into a slice of samples
+func (b *block) decode() ([]sample, error) {
+	return decodeBlock(b.bytes())
+}
+
+// decodeBlock decode a previously encoded block's raw bytes into samples.
+// The leading count header says exactly how many samples to read, so
+// decode never has to guess where the stream ends.
+func decodeBlock(data []byte) ([]sample, error) {
+	if len(data) < countHeaderSize {
+		return nil, nil
+	}
+
+	count := binary.BigEndian.Uint32(data[:countHeaderSize])
+	if count == 0 {
+		return nil, nil
+	}
+
+	r := newBitReader(data[countHeaderSize:])
+
+	t0, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	v0, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]sample, 1, count)
+	samples[0] = sample{Timestamp: int64(t0), Value: math.Float64frombits(v0)}
+
+	var prevDelta int64
+	var leading, trailing uint8
+	var haveWindow bool
+	prevTS := int64(t0)
+	prevBits := v0
+
+	for i := uint32(1); i < count; i++ {
+		dod, err := readDoD(r)
+		if err != nil {
+			return nil, err
+		}
+
+		var delta int64
+		if i == 1 {
+			delta = dod
+		} else {
+			delta = prevDelta + dod
+		}
+		ts := prevTS + delta
+
+		xorBit, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+
+		var bitsVal uint64
+		if xorBit == 0 {
+			bitsVal = prevBits
+		} else {
+			controlBit, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+
+			if controlBit == 1 {
+				lz, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				mlen, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				leading = uint8(lz)
+				// mlen is meaningful-1 (see writeXOR's bias), un-bias it
+				trailing = 64 - leading - (uint8(mlen) + 1)
+				haveWindow = true
+			}
+
+			if !haveWindow {
+				return nil, fmt.Errorf("gorilla, xor control bit set before any window was recorded")
+			}
+
+			meaningful := 64 - leading - trailing
+			meaningfulBits, err := r.readBits(uint(meaningful))
+			if err != nil {
+				return nil, err
+			}
+
+			xor := meaningfulBits << trailing
+			bitsVal = prevBits ^ xor
+		}
+
+		samples = append(samples, sample{Timestamp: ts, Value: math.Float64frombits(bitsVal)})
+
+		prevDelta = delta
+		prevTS = ts
+		prevBits = bitsVal
+	}
+
+	return samples, nil
+}
+
+// readDoD read one delta-of-delta timestamp value
+func readDoD(r *bitReader) (int64, error) {
+	b0, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if b0 == 0 {
+		return 0, nil
+	}
+
+	b1, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if b1 == 0 {
+		v, err := r.readBits(7)
+		if err != nil {
+			return 0, err
+		}
+		return int64(v) - 63, nil
+	}
+
+	b2, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if b2 == 0 {
+		v, err := r.readBits(9)
+		if err != nil {
+			return 0, err
+		}
+		return int64(v) - 255, nil
+	}
+
+	b3, err := r.readBit()
+	if err != nil {
+		return 0, err
+	}
+	if b3 == 0 {
+		v, err := r.readBits(12)
+		if err != nil {
+			return 0, err
+		}
+		return int64(v) - 2047, nil
+	}
+
+	v, err := r.readBits(32)
+	if err != nil {
+		return 0, err
+	}
+	return int64(int32(uint32(v))), nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gorilla
+
+import "testing"
+
+func TestBlockRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []sample
+	}{
+		{
+			name: "regular step, constant value",
+			samples: []sample{
+				{Timestamp: 1000, Value: 1.0},
+				{Timestamp: 2000, Value: 1.0},
+				{Timestamp: 3000, Value: 1.0},
+			},
+		},
+		{
+			name: "single sample",
+			samples: []sample{
+				{Timestamp: 1000, Value: 42.5},
+			},
+		},
+		{
+			name: "varying step and value, exercises new and reused xor windows",
+			samples: []sample{
+				{Timestamp: 1000, Value: 1.0},
+				{Timestamp: 2000, Value: 2.5},
+				{Timestamp: 3500, Value: 2.5},
+				{Timestamp: 4600, Value: -17.125},
+				{Timestamp: 4700, Value: 0},
+				{Timestamp: 9000, Value: 123456.789},
+			},
+		},
+		{
+			name: "stream ends mid-byte, final byte padded with zero bits",
+			samples: []sample{
+				{Timestamp: 1000, Value: 1.0},
+				{Timestamp: 2000, Value: 1.0},
+			},
+		},
+		{
+			// xor has both its top and bottom bit set, so
+			// leading == trailing == 0 and meaningful == 64 - the
+			// one case a plain 6-bit field can't hold without a bias.
+			name: "xor spans the full 64 bits (meaningful == 64)",
+			samples: []sample{
+				{Timestamp: 1000, Value: 1.0},
+				{Timestamp: 2000, Value: -1.0000000000000002},
+				{Timestamp: 3000, Value: 1.0},
+			},
+		},
+		{
+			// 1.0 and 1.0000000000000002 differ only in the lowest
+			// mantissa bit, so the xor's leading-zero count is 63 -
+			// past what the 5-bit leading field can hold unclamped.
+			name: "xor leading-zero count exceeds the 5-bit field (clamped to 31)",
+			samples: []sample{
+				{Timestamp: 1000, Value: 1.0},
+				{Timestamp: 2000, Value: 1.0000000000000002},
+				{Timestamp: 3000, Value: 100.0},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			blk := newBlock(c.samples[0].Timestamp)
+			for _, s := range c.samples {
+				if err := blk.append(s.Timestamp, s.Value); err != nil {
+					t.Fatalf("append(%d, %v): %v", s.Timestamp, s.Value, err)
+				}
+			}
+
+			got, err := blk.decode()
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+
+			if len(got) != len(c.samples) {
+				t.Fatalf("decode returned %d samples, want %d: %+v", len(got), len(c.samples), got)
+			}
+
+			for i, want := range c.samples {
+				if got[i] != want {
+					t.Errorf("sample %d = %+v, want %+v", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockRejectsOutOfOrderTimestamps(t *testing.T) {
+	blk := newBlock(1000)
+	if err := blk.append(1000, 1.0); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := blk.append(1000, 2.0); err == nil {
+		t.Fatal("append with a non-increasing timestamp should fail")
+	}
+	if err := blk.append(500, 2.0); err == nil {
+		t.Fatal("append with an out-of-order timestamp should fail")
+	}
+}
+
+func TestDecodeEmptyBlock(t *testing.T) {
+	samples, err := decodeBlock(nil)
+	if err != nil {
+		t.Fatalf("decodeBlock(nil): %v", err)
+	}
+	if len(samples) != 0 {
+		t.Fatalf("decodeBlock(nil) = %+v, want empty", samples)
+	}
+}
@@ -0,0 +1,584 @@
+// Copyright 2016,2017 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gorilla a storage.Backend storing samples in Gorilla TSDB
+// compressed blocks, giving roughly an order of magnitude better
+// memory/disk footprint than the memory and sqlite backends for typical
+// monitoring workloads
+package gorilla
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// name the storage name, as returned by Name()
+const name = "gorilla"
+
+// defaultDirname where blocks and the index are persisted
+const defaultDirname = "gorilla_data"
+
+// series in-memory state for a single metric id: its closed, on-disk
+// blocks plus the currently open, appendable block
+type series struct {
+	mu     sync.Mutex
+	id     string
+	tags   map[string]string
+	closed []int64 // block start times already flushed to disk
+	open   *block
+}
+
+// copyTags return a shallow copy of tags, so callers can read it after
+// releasing the series lock without racing a concurrent PutTags/DeleteTags
+func copyTags(tags map[string]string) map[string]string {
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		out[k] = v
+	}
+
+	return out
+}
+
+// Backend a storage.Backend storing samples as Gorilla compressed blocks
+type Backend struct {
+	dirname   string
+	retention time.Duration
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+// Name return the storage name
+func (b *Backend) Name() string {
+	return name
+}
+
+// Open init the backend, loading the on-disk index and starting the
+// retention goroutine if an `options=retention=<duration>` was given
+func (b *Backend) Open(options url.Values) {
+	b.dirname = defaultDirname
+	if d := options.Get("db-dirname"); d != "" {
+		b.dirname = d
+	}
+	os.MkdirAll(b.dirname, 0755)
+
+	b.series = map[string]*series{}
+	b.loadIndex()
+	b.loadOpenSnapshots()
+
+	if r := options.Get("retention"); r != "" {
+		if d, err := time.ParseDuration(r); err == nil {
+			b.retention = d
+			go b.retentionLoop()
+		}
+	}
+
+	go b.snapshotOnShutdown()
+}
+
+// seriesPath the directory holding a series' blocks, keyed by a
+// filesystem-safe hash of its id
+func (b *Backend) seriesPath(id string) string {
+	return filepath.Join(b.dirname, seriesDirName(id))
+}
+
+// seriesDirName turn a metric id into a filesystem-safe directory name
+func seriesDirName(id string) string {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return strconv.FormatUint(uint64(h), 16)
+}
+
+// indexEntry one row of the sidecar index file: metric id, tags and the
+// list of closed block start times flushed to disk
+type indexEntry struct {
+	ID     string            `json:"id"`
+	Tags   map[string]string `json:"tags"`
+	Closed []int64           `json:"closed"`
+}
+
+// indexPath the path of the id -> block list sidecar index
+func (b *Backend) indexPath() string {
+	return filepath.Join(b.dirname, "index.json")
+}
+
+// loadIndex read the sidecar index, recreating the in-memory series map
+func (b *Backend) loadIndex() {
+	data, err := ioutil.ReadFile(b.indexPath())
+	if err != nil {
+		return
+	}
+
+	var entries []indexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		b.series[e.ID] = &series{
+			id:     e.ID,
+			tags:   e.Tags,
+			closed: e.Closed,
+		}
+	}
+}
+
+// saveIndex persist the sidecar index
+func (b *Backend) saveIndex() {
+	b.mu.RLock()
+	entries := make([]indexEntry, 0, len(b.series))
+	for _, s := range b.series {
+		s.mu.Lock()
+		entries = append(entries, indexEntry{ID: s.id, Tags: copyTags(s.tags), Closed: append([]int64{}, s.closed...)})
+		s.mu.Unlock()
+	}
+	b.mu.RUnlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+
+	ioutil.WriteFile(b.indexPath(), data, 0644)
+}
+
+// getOrCreateSeries return the series for id, creating it if needed
+func (b *Backend) getOrCreateSeries(id string) *series {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.series[id]
+	if !ok {
+		s = &series{id: id}
+		b.series[id] = s
+	}
+
+	return s
+}
+
+// blockFilePath the on-disk path of a closed block,
+// <seriesDirName(id)>/<block_start>.tsz
+func (b *Backend) blockFilePath(id string, startTime int64) string {
+	return filepath.Join(b.seriesPath(id), fmt.Sprintf("%d.tsz", startTime))
+}
+
+// openSnapshotPath where a series' still-open block is snapshotted on
+// shutdown, so a restart can resume appending to it instead of losing up
+// to blockDuration worth of recent samples
+func (b *Backend) openSnapshotPath(id string) string {
+	return filepath.Join(b.seriesPath(id), "open.snap")
+}
+
+// openSnapshot the on-disk representation of a series' open block: its
+// decoded samples, replayed through append to rebuild the block's
+// internal encoder state
+type openSnapshot struct {
+	StartTime int64    `json:"startTime"`
+	Samples   []sample `json:"samples"`
+}
+
+// snapshotOnShutdown wait for SIGINT/SIGTERM and persist every series'
+// open block before letting the process die, so the only unflushed
+// writes lost on a crash are the ones a snapshot can't help with anyway
+func (b *Backend) snapshotOnShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	b.snapshotOpenBlocks()
+	os.Exit(0)
+}
+
+// snapshotOpenBlocks write every series' open block to its openSnapshotPath
+func (b *Backend) snapshotOpenBlocks() {
+	b.mu.RLock()
+	all := make([]*series, 0, len(b.series))
+	for _, s := range b.series {
+		all = append(all, s)
+	}
+	b.mu.RUnlock()
+
+	for _, s := range all {
+		s.mu.Lock()
+		if s.open == nil {
+			s.mu.Unlock()
+			continue
+		}
+
+		samples, err := s.open.decode()
+		startTime := s.open.StartTime
+		s.mu.Unlock()
+		if err != nil {
+			continue
+		}
+
+		data, err := json.Marshal(openSnapshot{StartTime: startTime, Samples: samples})
+		if err != nil {
+			continue
+		}
+
+		os.MkdirAll(b.seriesPath(s.id), 0755)
+		ioutil.WriteFile(b.openSnapshotPath(s.id), data, 0644)
+	}
+}
+
+// loadOpenSnapshots rebuild every series' open block from the snapshot a
+// previous shutdown left behind, removing the snapshot once it's
+// replayed so a later, orderly flush doesn't also find a stale copy
+func (b *Backend) loadOpenSnapshots() {
+	for _, s := range b.series {
+		data, err := ioutil.ReadFile(b.openSnapshotPath(s.id))
+		if err != nil {
+			continue
+		}
+
+		var snap openSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			continue
+		}
+
+		open := newBlock(snap.StartTime)
+		for _, smp := range snap.Samples {
+			if err := open.append(smp.Timestamp, smp.Value); err != nil {
+				continue
+			}
+		}
+		s.open = open
+
+		os.Remove(b.openSnapshotPath(s.id))
+	}
+}
+
+// flush write a closed block to disk and record it in the index
+func (b *Backend) flush(s *series, blk *block) error {
+	os.MkdirAll(b.seriesPath(s.id), 0755)
+
+	if err := ioutil.WriteFile(b.blockFilePath(s.id, blk.StartTime), blk.bytes(), 0644); err != nil {
+		return err
+	}
+
+	s.closed = append(s.closed, blk.StartTime)
+	os.Remove(b.openSnapshotPath(s.id))
+
+	return nil
+}
+
+// rawDataPoint a single Hawkular raw data point; matches the JSON wire
+// format the sqlite and memory backends exchange with the api package
+type rawDataPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// PostData append samples to the open block for each series in data, a
+// JSON array of `{"id":"...","data":[{"timestamp":...,"value":...}]}`
+func (b *Backend) PostData(tenantID, typ string, data []byte) bool {
+	var items []struct {
+		ID   string         `json:"id"`
+		Data []rawDataPoint `json:"data"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return false
+	}
+
+	for _, item := range items {
+		s := b.getOrCreateSeries(item.ID)
+
+		s.mu.Lock()
+		for _, p := range item.Data {
+			if s.open == nil || p.Timestamp >= s.open.StartTime+blockDuration {
+				if s.open != nil {
+					b.flush(s, s.open)
+				}
+				s.open = newBlock(p.Timestamp - p.Timestamp%blockDuration)
+			}
+
+			if err := s.open.append(p.Timestamp, p.Value); err != nil {
+				// out-of-order within the open block, drop the sample
+				continue
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	b.saveIndex()
+
+	return true
+}
+
+// GetData decode every block intersecting [start,end) and return the
+// matching samples as a JSON array of rawDataPoint
+func (b *Backend) GetData(tenantID, typ, id string, start, end, bucketDuration int64) []byte {
+	b.mu.RLock()
+	s, ok := b.series[id]
+	b.mu.RUnlock()
+	if !ok {
+		return []byte("[]")
+	}
+
+	points := []rawDataPoint{}
+
+	s.mu.Lock()
+	blockStarts := append([]int64{}, s.closed...)
+	if s.open != nil {
+		blockStarts = append(blockStarts, s.open.StartTime)
+	}
+	openStart := int64(-1)
+	if s.open != nil {
+		openStart = s.open.StartTime
+	}
+	var openBlockBytes []byte
+	if s.open != nil {
+		openBlockBytes = s.open.bytes()
+	}
+	s.mu.Unlock()
+
+	for _, blockStart := range blockStarts {
+		if blockStart+blockDuration <= start || blockStart >= end {
+			continue
+		}
+
+		var raw []byte
+		var err error
+		if blockStart == openStart {
+			raw = openBlockBytes
+		} else {
+			raw, err = ioutil.ReadFile(b.blockFilePath(id, blockStart))
+			if err != nil {
+				continue
+			}
+		}
+
+		samples, err := decodeBlock(raw)
+		if err != nil {
+			continue
+		}
+
+		for _, smp := range samples {
+			if smp.Timestamp >= start && smp.Timestamp < end {
+				points = append(points, rawDataPoint{Timestamp: smp.Timestamp, Value: smp.Value})
+			}
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+
+	out, err := json.Marshal(points)
+	if err != nil {
+		return []byte("[]")
+	}
+
+	return out
+}
+
+// metricDefinition a Hawkular metric definition, as returned by GetMetrics
+type metricDefinition struct {
+	ID   string            `json:"id"`
+	Tags map[string]string `json:"tags"`
+}
+
+// GetMetrics list the metric definitions whose tags match every
+// name=value pair in tags (a comma-separated filter, or "" for all)
+func (b *Backend) GetMetrics(tenantID, typ, tags string) []byte {
+	filter := map[string]string{}
+	for _, pair := range splitCommaSeparated(tags) {
+		kv := splitOnce(pair, "=")
+		if len(kv) == 2 {
+			filter[kv[0]] = kv[1]
+		}
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	defs := []metricDefinition{}
+	for _, s := range b.series {
+		s.mu.Lock()
+		tags := copyTags(s.tags)
+		s.mu.Unlock()
+
+		match := true
+		for k, v := range filter {
+			if tags[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			defs = append(defs, metricDefinition{ID: s.id, Tags: tags})
+		}
+	}
+
+	out, err := json.Marshal(defs)
+	if err != nil {
+		return []byte("[]")
+	}
+
+	return out
+}
+
+// GetTenants return the single tenant list the gorilla backend tracks;
+// tenancy is not partitioned on disk, matching the memory backend
+func (b *Backend) GetTenants() []byte {
+	return []byte(`[{"id":"default"}]`)
+}
+
+// PutTags merge tags into the series' tag index
+func (b *Backend) PutTags(tenantID, typ, id string, tags map[string]string) bool {
+	s := b.getOrCreateSeries(id)
+
+	s.mu.Lock()
+	if s.tags == nil {
+		s.tags = map[string]string{}
+	}
+	for k, v := range tags {
+		s.tags[k] = v
+	}
+	s.mu.Unlock()
+
+	b.saveIndex()
+
+	return true
+}
+
+// PutMultiTags apply PutTags over a JSON array of `{"id":...,"tags":{...}}`
+func (b *Backend) PutMultiTags(tenantID, typ string, data []byte) bool {
+	var items []struct {
+		ID   string            `json:"id"`
+		Tags map[string]string `json:"tags"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return false
+	}
+
+	for _, item := range items {
+		b.PutTags(tenantID, typ, item.ID, item.Tags)
+	}
+
+	return true
+}
+
+// DeleteTags remove tags from a series' tag index
+func (b *Backend) DeleteTags(tenantID, typ, id string, tags []string) bool {
+	b.mu.RLock()
+	s, ok := b.series[id]
+	b.mu.RUnlock()
+	if !ok {
+		return true
+	}
+
+	s.mu.Lock()
+	for _, k := range tags {
+		delete(s.tags, k)
+	}
+	s.mu.Unlock()
+
+	b.saveIndex()
+
+	return true
+}
+
+// DeleteData remove a series entirely: its closed blocks on disk, its
+// open block and its index entry
+func (b *Backend) DeleteData(tenantID, typ, id string) bool {
+	b.mu.Lock()
+	s, ok := b.series[id]
+	if ok {
+		delete(b.series, id)
+	}
+	b.mu.Unlock()
+
+	if ok {
+		os.RemoveAll(b.seriesPath(s.id))
+	}
+
+	b.saveIndex()
+
+	return true
+}
+
+// retentionLoop hourly, delete whole blocks older than the retention window
+func (b *Backend) retentionLoop() {
+	for range time.Tick(time.Hour) {
+		cutoff := time.Now().Add(-b.retention).UnixNano() / int64(time.Millisecond)
+
+		b.mu.RLock()
+		all := make([]*series, 0, len(b.series))
+		for _, s := range b.series {
+			all = append(all, s)
+		}
+		b.mu.RUnlock()
+
+		for _, s := range all {
+			s.mu.Lock()
+			kept := s.closed[:0]
+			for _, start := range s.closed {
+				if start+blockDuration < cutoff {
+					os.Remove(b.blockFilePath(s.id, start))
+					continue
+				}
+				kept = append(kept, start)
+			}
+			s.closed = kept
+			s.mu.Unlock()
+		}
+
+		b.saveIndex()
+	}
+}
+
+// splitCommaSeparated split a comma-separated filter string, ignoring
+// empty input
+func splitCommaSeparated(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	out := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ',' {
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	out = append(out, s[start:])
+
+	return out
+}
+
+// splitOnce split s on the first occurrence of sep
+func splitOnce(s, sep string) []string {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if s[i:i+len(sep)] == sep {
+			return []string{s[:i], s[i+len(sep):]}
+		}
+	}
+
+	return []string{s}
+}